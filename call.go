@@ -0,0 +1,156 @@
+package webchan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// reqHandler is a registered Handle callback, adapted to operate on interface{} values the same
+// way the rest of WebChan does.
+type reqHandler func(ctx context.Context, req interface{}) (interface{}, error)
+
+// Handle registers a handler for incoming Call requests carrying values of reqType's type. Only one
+// handler may be registered per type, and reqType must be one of wc's allowed types. Each request is
+// dispatched to the handler in its own goroutine, with a context that is cancelled if the caller's
+// Call context is cancelled before the handler returns.
+func (wc *WebChan) Handle(reqType interface{}, handler func(ctx context.Context, req interface{}) (interface{}, error)) error {
+	typeName, ok := wc.getAllowedTypeName(reqType)
+	if !ok {
+		return fmt.Errorf("type not allowed: %T", reqType)
+	}
+	wc.handlersMu.Lock()
+	defer wc.handlersMu.Unlock()
+	if _, exists := wc.handlers[typeName]; exists {
+		return fmt.Errorf("handler already registered for type: %s", typeName)
+	}
+	wc.handlers[typeName] = reqHandler(handler)
+	return nil
+}
+
+// Call sends req to the peer and blocks until it replies with a response (decoded into respPtr),
+// the peer's handler returns an error, ctx is cancelled, or wc is closed. req must be one of wc's
+// allowed types, and the peer must have a matching Handle registered for it.
+func (wc *WebChan) Call(ctx context.Context, req interface{}, respPtr interface{}) error {
+	typeName, ok := wc.getAllowedTypeName(req)
+	if !ok {
+		return fmt.Errorf("type not allowed: %T", req)
+	}
+	payload, err := wc.encodePayload(req)
+	if err != nil {
+		return err
+	}
+
+	id := atomic.AddInt64(&wc.nextCallID, 1)
+	replyCh := make(chan wireFrame, 1)
+	wc.callsMu.Lock()
+	wc.pendingCalls[id] = replyCh
+	wc.callsMu.Unlock()
+	defer func() {
+		wc.callsMu.Lock()
+		delete(wc.pendingCalls, id)
+		wc.callsMu.Unlock()
+	}()
+
+	if err := wc.encodeFrame(wireFrame{Kind: frameKindReq, ID: id, TypeName: typeName, Payload: payload}); err != nil {
+		return err
+	}
+
+	select {
+	case reply := <-replyCh:
+		if reply.Err != "" {
+			return fmt.Errorf("%s", reply.Err)
+		}
+		return wc.decodePayload(reply.Payload, respPtr)
+	case <-ctx.Done():
+		wc.encodeFrame(wireFrame{Kind: frameKindCancel, ID: id}) // Best effort, the call is already giving up.
+		return ctx.Err()
+	case <-wc.closeRecvChan:
+		return net.ErrClosed
+	}
+}
+
+// handleReqFrame dispatches an incoming Call request to its registered handler, if one exists, and
+// sends the handler's result back as a resp frame carrying the same ID.
+func (wc *WebChan) handleReqFrame(f wireFrame) {
+	wc.handlersMu.Lock()
+	handler, ok := wc.handlers[f.TypeName]
+	wc.handlersMu.Unlock()
+	if !ok {
+		wc.encodeFrame(wireFrame{Kind: frameKindResp, ID: f.ID, Err: fmt.Sprintf("no handler registered for type: %s", f.TypeName)})
+		return
+	}
+	reqVal, ok := wc.createTypeInterfaceReflectPointer(f.TypeName)
+	if !ok {
+		wc.encodeFrame(wireFrame{Kind: frameKindResp, ID: f.ID, Err: fmt.Sprintf("type not allowed: %s", f.TypeName)})
+		return
+	}
+	if err := wc.decodePayload(f.Payload, reqVal.Interface()); err != nil {
+		wc.encodeFrame(wireFrame{Kind: frameKindResp, ID: f.ID, Err: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wc.callsMu.Lock()
+	wc.cancelFuncs[f.ID] = cancel
+	wc.callsMu.Unlock()
+
+	go func() {
+		defer func() {
+			wc.callsMu.Lock()
+			delete(wc.cancelFuncs, f.ID)
+			wc.callsMu.Unlock()
+			cancel()
+		}()
+		resp, err := handler(ctx, reqVal.Elem().Interface())
+		if err != nil {
+			wc.reportSendErr(wc.encodeFrame(wireFrame{Kind: frameKindResp, ID: f.ID, Err: err.Error()}))
+			return
+		}
+		respPayload, err := wc.encodePayload(resp)
+		if err != nil {
+			wc.reportSendErr(wc.encodeFrame(wireFrame{Kind: frameKindResp, ID: f.ID, Err: err.Error()}))
+			return
+		}
+		wc.reportSendErr(wc.encodeFrame(wireFrame{Kind: frameKindResp, ID: f.ID, Payload: respPayload}))
+	}()
+}
+
+// handleRespFrame delivers a resp frame to the Call that is waiting on its ID, if any is still waiting.
+func (wc *WebChan) handleRespFrame(f wireFrame) {
+	wc.callsMu.Lock()
+	replyCh, ok := wc.pendingCalls[f.ID]
+	wc.callsMu.Unlock()
+	if !ok {
+		return // The Call already gave up (ctx cancelled or wc closed) and isn't listening any more.
+	}
+	replyCh <- f
+}
+
+// handleCancelFrame cancels the context passed to the handler processing request ID, if it is still running.
+func (wc *WebChan) handleCancelFrame(f wireFrame) {
+	wc.callsMu.Lock()
+	cancel, ok := wc.cancelFuncs[f.ID]
+	wc.callsMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// cancelAllHandlers cancels every in-flight handler goroutine, as happens when wc is closed.
+func (wc *WebChan) cancelAllHandlers() {
+	wc.callsMu.Lock()
+	defer wc.callsMu.Unlock()
+	for _, cancel := range wc.cancelFuncs {
+		cancel()
+	}
+}
+
+// reportSendErr reports err, if non nil, as a sendError on the Error channel. It exists so the
+// handler goroutine above can stay a one-liner per response path.
+func (wc *WebChan) reportSendErr(err error) {
+	if err != nil {
+		wc.tryPushError(&sendError{err})
+	}
+}
@@ -0,0 +1,91 @@
+package webchan
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes and decodes the payload of a single message. WebChan calls Encode/Decode once per
+// message against a fresh buffer (see encodePayload/decodePayload in webchan.go), never against the
+// live socket directly, so a Codec must not cache a stream encoder/decoder across calls: each call
+// gets its own w/r and must be self-contained. Name identifies the codec in the handshake
+// NewWebChanWithCodec performs, so a mismatched peer is caught immediately instead of silently
+// corrupting the stream.
+type Codec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+	Name() string
+}
+
+// JSONCodec is the default Codec, matching WebChan's original hard-coded json.Encoder/json.Decoder behavior.
+type JSONCodec struct{}
+
+func (c JSONCodec) Name() string { return "json" }
+
+func (c JSONCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (c JSONCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// GobCodec encodes payloads with encoding/gob. It is more compact and avoids JSON's marshalling
+// overhead, at the cost of payload types needing to be gob-encodable rather than json-encodable.
+type GobCodec struct{}
+
+func (c GobCodec) Name() string { return "gob" }
+
+func (c GobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (c GobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// ProtoCodec encodes payloads that implement proto.Message using the protobuf wire format. Unlike
+// JSONCodec and GobCodec, protobuf has no self-delimiting stream representation, so ProtoCodec
+// length-prefixes each message with a 4 byte big-endian length.
+type ProtoCodec struct{}
+
+func (c ProtoCodec) Name() string { return "proto" }
+
+func (c ProtoCodec) Encode(w io.Writer, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protocodec: %T does not implement proto.Message", v)
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var lenPrefix [4]byte
+	binary.BigEndian.PutUint32(lenPrefix[:], uint32(len(b)))
+	if _, err := w.Write(lenPrefix[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (c ProtoCodec) Decode(r io.Reader, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protocodec: %T does not implement proto.Message", v)
+	}
+	var lenPrefix [4]byte
+	if _, err := io.ReadFull(r, lenPrefix[:]); err != nil {
+		return err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(lenPrefix[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, m)
+}
@@ -0,0 +1,115 @@
+package webchan
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// creditTracker is a resizable counting semaphore: each unit of credit represents permission to
+// send one message on the default channel that hasn't yet been acknowledged by the peer.
+type creditTracker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	capacity  int
+	available int
+	closed    bool
+	// acked counts every ack frame ever released through this tracker, so a caller like
+	// ReconnectingWebChan's outbox can tell exactly how many of its in-order sends have actually been
+	// delivered, rather than guessing from a transient "nothing in flight right now" snapshot.
+	acked int64
+}
+
+// newCreditTracker starts with zero available credit: the local initialCredit argument is only
+// what we advertise to the peer, not what we may spend ourselves. acquire blocks until the peer's
+// own frameKindCredit frame arrives and reset applies its real, advertised capacity.
+func newCreditTracker(initial int) *creditTracker {
+	c := &creditTracker{}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// acquire blocks until a credit is available to spend, or the tracker is closed, in which case it
+// returns false.
+func (c *creditTracker) acquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.available == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return false
+	}
+	c.available--
+	return true
+}
+
+// release returns one credit to the pool, as happens whenever an ack frame arrives.
+func (c *creditTracker) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.available < c.capacity {
+		c.available++
+	}
+	c.acked++
+	c.cond.Broadcast()
+}
+
+// reset replaces the tracker's capacity with one freshly learned from the peer, fully available.
+func (c *creditTracker) reset(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+	c.available = capacity
+	c.cond.Broadcast()
+}
+
+func (c *creditTracker) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+}
+
+func (c *creditTracker) outstanding() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.available
+}
+
+func (c *creditTracker) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capacity - c.available
+}
+
+// ackedCount returns how many ack frames this tracker has ever released, as a cumulative count
+// rather than a point-in-time snapshot.
+func (c *creditTracker) ackedCount() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.acked
+}
+
+// handleCreditFrame applies the peer's initial credit announcement to our outgoing credit tracker.
+// Receiving one while flow control isn't enabled locally means the two ends were constructed
+// inconsistently (only one side used NewWebChanWithCredit), which we report rather than guess at.
+func (wc *WebChan) handleCreditFrame(f wireFrame) {
+	if wc.credit == nil {
+		wc.tryPushError(&recvError{fmt.Errorf("received a credit frame but flow control is not enabled locally")})
+		return
+	}
+	var n int
+	if err := json.Unmarshal(f.Payload, &n); err != nil {
+		wc.tryPushError(&recvError{err})
+		return
+	}
+	wc.credit.reset(n)
+}
+
+// handleAckFrame returns one credit, as the peer has just told us it delivered a data frame we sent.
+func (wc *WebChan) handleAckFrame() {
+	if wc.credit != nil {
+		wc.credit.release()
+	}
+}
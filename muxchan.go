@@ -0,0 +1,163 @@
+package webchan
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// namedChan holds the local state for one multiplexed channel: the buffered
+// send/recv channels handed to the caller, and the type it carries on the wire.
+type namedChan struct {
+	typeName  string
+	send      chan interface{}
+	recv      chan interface{}
+	closeRecv sync.Once
+}
+
+// OpenChan opens a new named channel multiplexed over wc's underlying socket, and tells the peer
+// about it with an open frame so AcceptChan on the other end can pick it up.
+// elemType is an example of the only type that will be sent/received on this channel; it must be
+// one of the types wc was constructed with. bufLen is the buffer length of the returned channels.
+// The returned send/recv channels behave like WebChan's own Send/Recv: pushing to send queues data
+// for delivery, and recv is closed when the peer closes their end of this named channel or wc itself closes.
+func (wc *WebChan) OpenChan(name string, elemType interface{}, bufLen int) (chan<- interface{}, <-chan interface{}, error) {
+	typeName, ok := wc.getAllowedTypeName(elemType)
+	if !ok {
+		return nil, nil, fmt.Errorf("type not allowed: %T", elemType)
+	}
+
+	wc.chansMu.Lock()
+	if _, exists := wc.namedChans[name]; exists {
+		wc.chansMu.Unlock()
+		return nil, nil, fmt.Errorf("channel already open: %s", name)
+	}
+	nc := &namedChan{
+		typeName: typeName,
+		send:     make(chan interface{}, bufLen),
+		recv:     make(chan interface{}, bufLen),
+	}
+	wc.namedChans[name] = nc
+	wc.chansMu.Unlock()
+	wc.chansCond.Broadcast()
+
+	if err := wc.encodeFrame(wireFrame{Kind: frameKindOpen, ChannelID: name, TypeName: typeName}); err != nil {
+		return nil, nil, err
+	}
+	go wc.namedSendLoop(name, nc)
+	return nc.send, nc.recv, nil
+}
+
+// AcceptChan waits for the peer to OpenChan a named channel with the given name, and returns the
+// local send/recv channels for it. It blocks until that happens or wc is closed, in which case it
+// returns net.ErrClosed. Buffering for accepted channels uses the bufLength wc itself was created with.
+func (wc *WebChan) AcceptChan(name string) (chan<- interface{}, <-chan interface{}, error) {
+	wc.chansMu.Lock()
+	defer wc.chansMu.Unlock()
+	for {
+		if nc, ok := wc.namedChans[name]; ok {
+			return nc.send, nc.recv, nil
+		}
+		select {
+		case <-wc.closeRecvChan:
+			return nil, nil, net.ErrClosed
+		default:
+		}
+		wc.chansCond.Wait()
+	}
+}
+
+// namedSendLoop drains a named channel's send chan, framing and writing each value to the socket,
+// until either the caller closes the send chan (a close frame is then sent to the peer) or wc itself
+// is closed (wc.closeRecvChan fires, same as the default Send routine exiting on wc.Send closing).
+// wc.Close never closes nc.send itself: the caller owns that channel and may already have closed it
+// themselves, and two independent code paths racing to close the same channel would panic.
+func (wc *WebChan) namedSendLoop(name string, nc *namedChan) {
+	for {
+		select {
+		case data, ok := <-nc.send:
+			if !ok {
+				wc.encodeFrame(wireFrame{Kind: frameKindClose, ChannelID: name})
+				return
+			}
+			payload, err := wc.encodePayload(data)
+			if err == nil {
+				err = wc.encodeFrame(wireFrame{Kind: frameKindData, ChannelID: name, TypeName: nc.typeName, Payload: payload})
+			}
+			if err != nil {
+				wc.tryPushError(&sendError{err})
+			}
+		case <-wc.closeRecvChan:
+			return
+		}
+	}
+}
+
+// handleOpenFrame registers a named channel the peer just opened, so a pending or future AcceptChan
+// for that name can be satisfied, and so data/close frames for it have somewhere to go.
+func (wc *WebChan) handleOpenFrame(f wireFrame) {
+	wc.chansMu.Lock()
+	if _, exists := wc.namedChans[f.ChannelID]; exists {
+		wc.chansMu.Unlock()
+		return
+	}
+	nc := &namedChan{
+		typeName: f.TypeName,
+		send:     make(chan interface{}, wc.bufLength),
+		recv:     make(chan interface{}, wc.bufLength),
+	}
+	wc.namedChans[f.ChannelID] = nc
+	wc.chansMu.Unlock()
+	wc.chansCond.Broadcast()
+
+	go wc.namedSendLoop(f.ChannelID, nc)
+}
+
+// handleCloseFrame closes the recv side of the named channel the peer just closed. It never
+// touches the send side: a close frame only ever means "I'm done sending you data".
+func (wc *WebChan) handleCloseFrame(f wireFrame) {
+	wc.chansMu.Lock()
+	nc, ok := wc.namedChans[f.ChannelID]
+	wc.chansMu.Unlock()
+	if !ok {
+		return
+	}
+	nc.closeRecv.Do(func() {
+		close(nc.recv)
+	})
+}
+
+// handleNamedDataFrame decodes a data frame addressed to a named channel and delivers it to that
+// channel's recv chan.
+func (wc *WebChan) handleNamedDataFrame(f wireFrame) {
+	wc.chansMu.Lock()
+	nc, ok := wc.namedChans[f.ChannelID]
+	wc.chansMu.Unlock()
+	if !ok {
+		wc.tryPushError(&recvError{fmt.Errorf("data for unknown channel: %s", f.ChannelID)})
+		return
+	}
+	data, ok := wc.createTypeInterfaceReflectPointer(nc.typeName)
+	if !ok {
+		wc.tryPushError(&recvError{fmt.Errorf("type not allowed: %s", nc.typeName)})
+		return
+	}
+	if err := wc.decodePayload(f.Payload, data.Interface()); err != nil {
+		wc.tryPushError(&recvError{err})
+		return
+	}
+	nc.recv <- data.Elem().Interface()
+}
+
+// closeAllNamedChans closes the recv side of every named channel still open, and wakes up any
+// goroutines blocked in AcceptChan, when the underlying socket goes away.
+func (wc *WebChan) closeAllNamedChans() {
+	wc.chansMu.Lock()
+	defer wc.chansMu.Unlock()
+	for _, nc := range wc.namedChans {
+		nc.closeRecv.Do(func() {
+			close(nc.recv)
+		})
+	}
+	wc.chansCond.Broadcast()
+}
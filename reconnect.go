@@ -0,0 +1,279 @@
+package webchan
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dialer establishes the underlying connection a ReconnectingWebChan multiplexes over. Implementations
+// typically wrap net.Dial/tls.Dial with a fixed address.
+type Dialer interface {
+	Dial(ctx context.Context) (net.Conn, error)
+}
+
+// BackoffPolicy decides how long to wait before the next redial attempt, given how many consecutive
+// attempts have already failed (starting at 1).
+type BackoffPolicy interface {
+	Next(attempt int) time.Duration
+}
+
+// ExponentialBackoff is a BackoffPolicy that doubles the delay on each attempt, up to Max, with up to
+// 50% jitter added to avoid many reconnecting peers retrying in lockstep.
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+func (b ExponentialBackoff) Next(attempt int) time.Duration {
+	d := b.Initial
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= b.Max {
+			d = b.Max
+			break
+		}
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/2 + 1))
+	return d + jitter
+}
+
+// ConnState describes a ReconnectingWebChan's connectivity, delivered on its State channel.
+type ConnState string
+
+const (
+	StateConnected    ConnState = "connected"
+	StateDisconnected ConnState = "disconnected"
+	StateReconnecting ConnState = "reconnecting"
+)
+
+// ReconnectingWebChan wraps a WebChan with a supervisor that redials with Dialer and backs off with
+// BackoffPolicy whenever the underlying connection fails, instead of permanently closing Recv like a
+// plain WebChan does. Send, Recv and Error stay stable across reconnects: the application never needs
+// to know a redial happened, beyond watching State if it wants to surface connectivity in a UI.
+//
+// Outbound messages sent while disconnected queue on Send like always. Messages already handed to a
+// since-failed connection are tracked in a best-effort outbox (relying on the same credit/ack
+// machinery as NewWebChanWithCredit) and are replayed, in order, onto the new connection before
+// resuming normal traffic. This is a coarse delivery guarantee, not exactly-once: a message can be
+// replayed after the peer already processed it if the ack for it was itself lost in the failure.
+type ReconnectingWebChan struct {
+	Send  chan interface{}
+	Recv  chan interface{}
+	Error chan error
+	State chan ConnState
+
+	dialer       Dialer
+	bufLength    int
+	policy       BackoffPolicy
+	allowedTypes []interface{}
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	current *WebChan
+	outbox  []interface{}
+}
+
+// NewReconnectingWebChan creates a ReconnectingWebChan that dials with dialer, buffers bufLength
+// messages in each direction, and backs off with policy between redial attempts.
+func NewReconnectingWebChan(dialer Dialer, bufLength int, policy BackoffPolicy, allowedTypes ...interface{}) *ReconnectingWebChan {
+	rwc := &ReconnectingWebChan{
+		Send:         make(chan interface{}, bufLength),
+		Recv:         make(chan interface{}, bufLength),
+		Error:        make(chan error, 100),
+		State:        make(chan ConnState, 16),
+		dialer:       dialer,
+		bufLength:    bufLength,
+		policy:       policy,
+		allowedTypes: allowedTypes,
+		closeCh:      make(chan struct{}),
+	}
+	rwc.wg.Add(1)
+	go func() {
+		defer rwc.wg.Done()
+		rwc.supervise()
+	}()
+	go func() {
+		rwc.wg.Wait()
+		close(rwc.Recv)
+	}()
+	return rwc
+}
+
+// Close permanently shuts down the ReconnectingWebChan: no further redial attempts are made, Send is
+// closed, the current underlying connection (if any) is closed, and Recv closes once draining finishes.
+// Close will only do something on the first time it is called, subsequent calls will do nothing.
+func (rwc *ReconnectingWebChan) Close() {
+	rwc.closeOnce.Do(func() {
+		close(rwc.closeCh)
+		close(rwc.Send)
+		rwc.mu.Lock()
+		cur := rwc.current
+		rwc.mu.Unlock()
+		if cur != nil {
+			cur.Close()
+		}
+	})
+}
+
+func (rwc *ReconnectingWebChan) supervise() {
+	attempt := 0
+	for {
+		select {
+		case <-rwc.closeCh:
+			return
+		default:
+		}
+
+		rwc.pushState(StateReconnecting)
+		conn, err := rwc.dialer.Dial(context.Background())
+		if err != nil {
+			rwc.tryPushError(err)
+			attempt++
+			if !rwc.waitBackoff(attempt) {
+				return
+			}
+			continue
+		}
+		attempt = 0
+
+		wc := NewWebChanWithCredit(conn, rwc.bufLength, rwc.bufLength, rwc.allowedTypes...)
+		rwc.mu.Lock()
+		rwc.current = wc
+		toReplay := append([]interface{}(nil), rwc.outbox...)
+		rwc.mu.Unlock()
+
+		if !rwc.replay(wc, toReplay) {
+			wc.Close()
+			return
+		}
+		rwc.pushState(StateConnected)
+
+		rwc.pump(wc)
+
+		wc.Close()
+		rwc.mu.Lock()
+		if rwc.current == wc {
+			rwc.current = nil
+		}
+		rwc.mu.Unlock()
+		rwc.pushState(StateDisconnected)
+	}
+}
+
+// replay resends messages that may not have reached the peer on a previous connection. It returns
+// false if wc is closed before replay finishes.
+func (rwc *ReconnectingWebChan) replay(wc *WebChan, toReplay []interface{}) bool {
+	for _, v := range toReplay {
+		select {
+		case wc.Send <- v:
+		case <-rwc.closeCh:
+			return false
+		}
+	}
+	return true
+}
+
+// pump forwards traffic between rwc's stable channels and wc for as long as wc stays connected,
+// returning once wc disconnects (its Recv closes) or rwc is closed.
+func (rwc *ReconnectingWebChan) pump(wc *WebChan) {
+	recvDone := make(chan struct{})
+	var recvDoneOnce sync.Once
+	closeRecvDone := func() { recvDoneOnce.Do(func() { close(recvDone) }) }
+
+	var trimmed int64
+
+	var inner sync.WaitGroup
+	inner.Add(2)
+	go func() {
+		defer inner.Done()
+		defer closeRecvDone()
+		for v := range wc.Recv {
+			select {
+			case rwc.Recv <- v:
+			case <-rwc.closeCh:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer inner.Done()
+		for {
+			select {
+			case err, ok := <-wc.Error:
+				if !ok {
+					return
+				}
+				rwc.tryPushError(err)
+			case <-recvDone:
+				return
+			}
+		}
+	}()
+	defer inner.Wait()
+
+	for {
+		select {
+		case v, ok := <-rwc.Send:
+			if !ok {
+				return
+			}
+			rwc.mu.Lock()
+			rwc.outbox = append(rwc.outbox, v)
+			rwc.mu.Unlock()
+			select {
+			case wc.Send <- v:
+				// Outbox entries are acked strictly in order, so however many acks wc's credit tracker
+				// has seen so far, that many entries from the front of the outbox are now confirmed
+				// delivered and safe to drop.
+				if acked := wc.credit.ackedCount(); acked > trimmed {
+					rwc.mu.Lock()
+					n := acked - trimmed
+					if n > int64(len(rwc.outbox)) {
+						n = int64(len(rwc.outbox))
+					}
+					rwc.outbox = rwc.outbox[n:]
+					rwc.mu.Unlock()
+					trimmed = acked
+				}
+			case <-recvDone:
+				return
+			case <-rwc.closeCh:
+				return
+			}
+		case <-recvDone:
+			return
+		case <-rwc.closeCh:
+			return
+		}
+	}
+}
+
+func (rwc *ReconnectingWebChan) waitBackoff(attempt int) bool {
+	select {
+	case <-time.After(rwc.policy.Next(attempt)):
+		return true
+	case <-rwc.closeCh:
+		return false
+	}
+}
+
+func (rwc *ReconnectingWebChan) pushState(s ConnState) {
+	select {
+	case rwc.State <- s:
+	default:
+		// State is best-effort, like Error: a slow consumer just misses transient states.
+	}
+}
+
+func (rwc *ReconnectingWebChan) tryPushError(err error) {
+	select {
+	case rwc.Error <- err:
+	default:
+	}
+}
@@ -3,20 +3,73 @@
 package webchan
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
+// frameKind identifies what a wireFrame represents on the wire.
+type frameKind string
+
+const (
+	// frameKindData carries a payload for either the default channel (ChannelID == "") or a named channel.
+	frameKindData frameKind = "data"
+	// frameKindOpen announces that the sender has opened a named channel, so the peer can start routing data for it.
+	frameKindOpen frameKind = "open"
+	// frameKindClose announces that the sender has closed their end of a named channel.
+	frameKindClose frameKind = "close"
+	// frameKindCredit announces the sender's initial credit grant for the default channel, see NewWebChanWithCredit.
+	frameKindCredit frameKind = "credit"
+	// frameKindAck acknowledges that a data frame on the default channel was delivered, returning one credit.
+	frameKindAck frameKind = "ack"
+	// frameKindReq carries a Call request to a registered Handle handler, see call.go.
+	frameKindReq frameKind = "req"
+	// frameKindResp carries the result of a Call request back to the caller, see call.go.
+	frameKindResp frameKind = "resp"
+	// frameKindCancel tells the peer's handler that the Call which sent a given request ID has given up waiting.
+	frameKindCancel frameKind = "cancel"
+	// frameKindHandshake is the first frame exchanged by a WebChan created with NewWebChanWithCodec,
+	// advertising the codec and allowed-type manifest it is using.
+	frameKindHandshake frameKind = "handshake"
+)
+
+// wireFrame is the single envelope encoded/decoded for every message sent over the socket.
+// Using one envelope type (instead of the pair of bare Encode calls this package started with)
+// is what lets a single socket carry the default Send/Recv traffic alongside any number of named channels.
+type wireFrame struct {
+	Kind      frameKind `json:"kind"`
+	ChannelID string    `json:"channelId,omitempty"`
+	TypeName  string    `json:"typeName,omitempty"`
+	// Payload holds the Codec-encoded bytes for data/req/resp frames. It is plain []byte (base64'd by
+	// the JSON envelope) rather than json.RawMessage, since a non-JSON Codec's output (gob, protobuf)
+	// is not itself valid JSON and would otherwise corrupt the outer envelope.
+	Payload []byte `json:"payload,omitempty"`
+	// ID correlates a Call's req/resp/cancel frames (see call.go). Unused by every other frame kind.
+	ID int64 `json:"id,omitempty"`
+	// Err carries a Call handler's error back to the caller on a resp frame.
+	Err string `json:"err,omitempty"`
+	// CodecName and AllowedTypes are only set on a frameKindHandshake frame, see NewWebChanWithCodec.
+	CodecName    string   `json:"codecName,omitempty"`
+	AllowedTypes []string `json:"allowedTypes,omitempty"`
+}
+
 // WebChan is a wrapper for a web socket which enables sending of typed data over the socket.
 // Sending and receiving data is done through the Send and Recv channels, and errors are sent through the Error channel.
 // This means that WebChan is completely thread safe, and can be used in a concurrent environment.
 // WebChan takes the error handling approach of logging errors to the error channel and continuing operations,
 // with the exception of io.EOF and net.ErrClosed errors, which will close the Recv channel and stop reading from the socket.
 // The Close() method can be used to shutdown the WebChan and it's underlying socket.
+//
+// On top of this default Send/Recv pair, WebChan can also multiplex any number of independent named channels
+// over the same socket: see OpenChan and AcceptChan.
 type WebChan struct {
 	// The send channel to send data over the socket.
 	// Pushing data to this channel will send the data at some point in the future (it is non instantanious, but order will be preserved).
@@ -35,8 +88,34 @@ type WebChan struct {
 	closeRecvChan chan struct{}
 	soc           net.Conn
 	allowedTypes  map[string]reflect.Type
-	encoder       *json.Encoder
-	decoder       *json.Decoder
+	bufLength     int
+	// encoder/decoder frame the envelope itself (kind, channel id, type name, ...) and are always
+	// JSON: it's the Payload bytes inside that envelope that payloadCodec controls.
+	encoder *json.Encoder
+	decoder *json.Decoder
+	encMu   sync.Mutex
+	// payloadCodec encodes/decodes the Payload bytes of data/req/resp frames. Defaults to JSONCodec;
+	// see NewWebChanWithCodec to use something else.
+	payloadCodec  Codec
+	doHandshake   bool
+	handshakeDone bool
+	// initFramesSent is closed once the handshake/credit announcement frames (if any) have been
+	// written, so the Send routine can wait on it and never race those frames for the encoder.
+	initFramesSent chan struct{}
+
+	chansMu    sync.Mutex
+	chansCond  *sync.Cond
+	namedChans map[string]*namedChan
+
+	credit        *creditTracker
+	droppedErrors int64
+
+	callsMu      sync.Mutex
+	nextCallID   int64
+	pendingCalls map[int64]chan wireFrame
+	cancelFuncs  map[int64]context.CancelFunc
+	handlersMu   sync.Mutex
+	handlers     map[string]reqHandler
 }
 
 // NewWebChan creates a new WebChan with the given socket, buffer length and allowed types.
@@ -57,36 +136,135 @@ func NewWebChan(soc net.Conn, bufLength int, allowedTypes ...interface{}) *WebCh
 // Names must be unique.
 // IMPORTANT: All types must be json serializable.
 func NewNamedWebChan(soc net.Conn, bufLength int, allowedTypes map[string]interface{}) *WebChan {
+	return newWebChan(soc, bufLength, allowedTypes, 0, &JSONCodec{}, false)
+}
+
+// NewWebChanWithCredit creates a new WebChan like NewWebChan, but additionally applies credit-based
+// flow control to the default Send/Recv pair: on connect, each side advertises initialCredit to the
+// peer as the number of messages it may have in flight before it must wait for acks. Every value
+// delivered into Recv immediately frees up one credit on the peer's side, so a fast sender blocks on
+// Send once the slow receiver's credit is exhausted, instead of only relying on local buffering.
+// initialCredit must be greater than zero. Use Stats to inspect the current credit state.
+func NewWebChanWithCredit(soc net.Conn, bufLength int, initialCredit int, allowedTypes ...interface{}) *WebChan {
+	if initialCredit <= 0 {
+		panic("webchan: initialCredit must be greater than zero")
+	}
+	allowedTypesMap := make(map[string]interface{}, len(allowedTypes))
+	for _, v := range allowedTypes {
+		allowedTypesMap[fmt.Sprintf("%T", v)] = v
+	}
+	return newWebChan(soc, bufLength, allowedTypesMap, initialCredit, &JSONCodec{}, false)
+}
+
+// NewWebChanWithCodec creates a new WebChan like NewWebChan, but encodes/decodes data, Call and
+// Handle payloads with codec instead of the default JSON. Both peers must agree on a codec: right
+// after connecting, each side sends a handshake frame advertising its codec's Name() and its
+// allowed-type manifest, and if the peer's handshake doesn't match, a recvError is pushed to Error
+// and wc is closed rather than silently corrupting the stream.
+func NewWebChanWithCodec(soc net.Conn, bufLength int, codec Codec, allowedTypes ...interface{}) *WebChan {
+	allowedTypesMap := make(map[string]interface{}, len(allowedTypes))
+	for _, v := range allowedTypes {
+		allowedTypesMap[fmt.Sprintf("%T", v)] = v
+	}
+	return newWebChan(soc, bufLength, allowedTypesMap, 0, codec, true)
+}
+
+// Stats reports flow-control metrics for a WebChan created with NewWebChanWithCredit: how many
+// credits are currently available to spend, how many sent messages are still awaiting an ack, and
+// how many errors have been dropped because the Error channel was full. Stats is always safe to
+// call, but returns a zero Stats for a WebChan without credit-based flow control enabled.
+type Stats struct {
+	OutstandingCredits int
+	InFlightMessages   int
+	DroppedErrors      int64
+}
+
+func (wc *WebChan) Stats() Stats {
+	if wc.credit == nil {
+		return Stats{DroppedErrors: atomic.LoadInt64(&wc.droppedErrors)}
+	}
+	return Stats{
+		OutstandingCredits: wc.credit.outstanding(),
+		InFlightMessages:   wc.credit.inFlight(),
+		DroppedErrors:      atomic.LoadInt64(&wc.droppedErrors),
+	}
+}
+
+func newWebChan(soc net.Conn, bufLength int, allowedTypes map[string]interface{}, initialCredit int, codec Codec, doHandshake bool) *WebChan {
 	allowedTypesReflect := make(map[string]reflect.Type, len(allowedTypes))
 	for k, v := range allowedTypes {
 		allowedTypesReflect[k] = reflect.TypeOf(v)
 	}
 	wc := &WebChan{
-		make(chan interface{}, bufLength),
-		make(chan interface{}, bufLength),
-		make(chan error, 100),
-		make(chan struct{}),
-		soc,
-		allowedTypesReflect,
-		json.NewEncoder(soc),
-		json.NewDecoder(soc),
+		Send:           make(chan interface{}, bufLength),
+		Recv:           make(chan interface{}, bufLength),
+		Error:          make(chan error, 100),
+		closeRecvChan:  make(chan struct{}),
+		soc:            soc,
+		allowedTypes:   allowedTypesReflect,
+		bufLength:      bufLength,
+		encoder:        json.NewEncoder(soc),
+		decoder:        json.NewDecoder(soc),
+		payloadCodec:   codec,
+		doHandshake:    doHandshake,
+		initFramesSent: make(chan struct{}),
+		namedChans:     make(map[string]*namedChan),
+		pendingCalls:   make(map[int64]chan wireFrame),
+		cancelFuncs:    make(map[int64]context.CancelFunc),
+		handlers:       make(map[string]reqHandler),
+	}
+	wc.chansCond = sync.NewCond(&wc.chansMu)
+	if initialCredit > 0 {
+		wc.credit = newCreditTracker(initialCredit)
 	}
 
+	// The handshake and initial credit announcement must reach the peer before any other frame, or a
+	// peer doing handshake verification can see an ordinary data/credit frame first and tear the
+	// connection down. Write them from one goroutine, in order, and have the Send routine wait for
+	// initFramesSent to close before writing anything itself, instead of racing separate goroutines
+	// against each other for the encoder.
+	go func() {
+		defer close(wc.initFramesSent)
+		if wc.doHandshake {
+			manifest := make([]string, 0, len(wc.allowedTypes))
+			for name := range wc.allowedTypes {
+				manifest = append(manifest, name)
+			}
+			sort.Strings(manifest)
+			if err := wc.encodeFrame(wireFrame{Kind: frameKindHandshake, CodecName: wc.payloadCodec.Name(), AllowedTypes: manifest}); err != nil {
+				wc.tryPushError(&sendError{err})
+			}
+		}
+		if wc.credit != nil {
+			payload, err := json.Marshal(initialCredit)
+			if err == nil {
+				err = wc.encodeFrame(wireFrame{Kind: frameKindCredit, Payload: payload})
+			}
+			if err != nil {
+				wc.tryPushError(&sendError{err})
+			}
+		}
+	}()
+
 	// Send routine
 	go func() {
+		<-wc.initFramesSent
 		for {
 			// To close this goroutine, we should close the Send channel
 			data, ok := <-wc.Send
 			if !ok {
 				return
 			}
+			if wc.credit != nil && !wc.credit.acquire() {
+				continue
+			}
 			typeName, ok := wc.getAllowedTypeName(data)
 			if !ok {
 				panic(&sendError{fmt.Errorf("type not allowed: %T", data)})
 			}
-			err := wc.encoder.Encode(typeName)
+			payload, err := wc.encodePayload(data)
 			if err == nil {
-				err = wc.encoder.Encode(data)
+				err = wc.encodeFrame(wireFrame{Kind: frameKindData, TypeName: typeName, Payload: payload})
 			}
 			if err != nil {
 				wc.tryPushError(&sendError{err})
@@ -98,14 +276,15 @@ func NewNamedWebChan(soc net.Conn, bufLength int, allowedTypes map[string]interf
 	go func() {
 		defer func() {
 			close(wc.Recv)
+			wc.closeAllNamedChans()
 		}()
 		for {
 			select {
 			case <-wc.closeRecvChan:
 				return
 			default:
-				var typeName string
-				err := wc.decoder.Decode(&typeName)
+				var f wireFrame
+				err := wc.decoder.Decode(&f)
 				if err != nil {
 					if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
 						return
@@ -114,21 +293,39 @@ func NewNamedWebChan(soc net.Conn, bufLength int, allowedTypes map[string]interf
 					}
 					continue
 				}
-				data, ok := wc.createTypeInterfaceReflectPointer(typeName)
-				if !ok {
-					wc.tryPushError(&recvError{fmt.Errorf("type not allowed: %s", typeName)})
+				if wc.doHandshake && !wc.handshakeDone {
+					if verifyErr := wc.verifyHandshake(f); verifyErr != nil {
+						wc.tryPushError(&recvError{verifyErr})
+						wc.Close()
+						return
+					}
+					wc.handshakeDone = true
 					continue
 				}
-				err = wc.decoder.Decode(data.Interface())
-				if err != nil {
-					if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
-						return
+				switch f.Kind {
+				case frameKindOpen:
+					wc.handleOpenFrame(f)
+				case frameKindClose:
+					wc.handleCloseFrame(f)
+				case frameKindCredit:
+					wc.handleCreditFrame(f)
+				case frameKindAck:
+					wc.handleAckFrame()
+				case frameKindReq:
+					wc.handleReqFrame(f)
+				case frameKindResp:
+					wc.handleRespFrame(f)
+				case frameKindCancel:
+					wc.handleCancelFrame(f)
+				case frameKindData:
+					if f.ChannelID == "" {
+						wc.handleDefaultDataFrame(f)
 					} else {
-						wc.tryPushError(&recvError{err})
+						wc.handleNamedDataFrame(f)
 					}
-					continue
+				default:
+					wc.tryPushError(&recvError{fmt.Errorf("unknown frame kind: %s", f.Kind)})
 				}
-				wc.Recv <- data.Elem().Interface()
 			}
 
 		}
@@ -136,6 +333,24 @@ func NewNamedWebChan(soc net.Conn, bufLength int, allowedTypes map[string]interf
 	return wc
 }
 
+func (wc *WebChan) handleDefaultDataFrame(f wireFrame) {
+	data, ok := wc.createTypeInterfaceReflectPointer(f.TypeName)
+	if !ok {
+		wc.tryPushError(&recvError{fmt.Errorf("type not allowed: %s", f.TypeName)})
+		return
+	}
+	if err := wc.decodePayload(f.Payload, data.Interface()); err != nil {
+		wc.tryPushError(&recvError{err})
+		return
+	}
+	wc.Recv <- data.Elem().Interface()
+	if wc.credit != nil {
+		if err := wc.encodeFrame(wireFrame{Kind: frameKindAck}); err != nil {
+			wc.tryPushError(&sendError{err})
+		}
+	}
+}
+
 // Close does not immidiately stop all processing, but will close both the send and recv channel, and soon stop reading the incoming socket and close it too.
 // Close will only do somthing on the first time it is called, subsequent calls will do nothing.
 func (wc *WebChan) Close() {
@@ -148,10 +363,74 @@ func (wc *WebChan) Close() {
 	default:
 		close(wc.closeRecvChan)
 		close(wc.Send)
+		// namedSendLoop selects on wc.closeRecvChan too, so closing it above already wakes up every
+		// open named channel's send loop; we never touch nc.send, which the caller owns.
+		if wc.credit != nil {
+			wc.credit.close() // Wake up any send routine blocked waiting for credit
+		}
+		wc.cancelAllHandlers()
 		wc.soc.Close() // This will cause blocking operations on the socket to error out of blocking
 	}
 }
 
+// encodeFrame writes a single wireFrame to the socket, guarding the encoder so the default send
+// routine and any number of named channel send routines can share it safely.
+func (wc *WebChan) encodeFrame(f wireFrame) error {
+	wc.encMu.Lock()
+	defer wc.encMu.Unlock()
+	return wc.encoder.Encode(f)
+}
+
+// encodePayload encodes data with wc's payload codec, ready to drop into a wireFrame's Payload field.
+func (wc *WebChan) encodePayload(data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := wc.payloadCodec.Encode(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodePayload decodes a wireFrame's Payload field with wc's payload codec into ptr.
+func (wc *WebChan) decodePayload(payload []byte, ptr interface{}) error {
+	return wc.payloadCodec.Decode(bytes.NewReader(payload), ptr)
+}
+
+// verifyHandshake checks a peer's handshake frame against our own codec and allowed-type manifest.
+func (wc *WebChan) verifyHandshake(f wireFrame) error {
+	if f.Kind != frameKindHandshake {
+		return fmt.Errorf("expected a handshake frame, got kind %q", f.Kind)
+	}
+	if f.CodecName != wc.payloadCodec.Name() {
+		return fmt.Errorf("codec mismatch: peer is using %q, we are using %q", f.CodecName, wc.payloadCodec.Name())
+	}
+	ours := make(map[string]bool, len(wc.allowedTypes))
+	for name := range wc.allowedTypes {
+		ours[name] = true
+	}
+	theirs := make(map[string]bool, len(f.AllowedTypes))
+	for _, name := range f.AllowedTypes {
+		theirs[name] = true
+	}
+	if len(ours) != len(theirs) {
+		return fmt.Errorf("allowed-type manifest mismatch: we allow %v, peer allows %v", wc.allowedTypeNames(), f.AllowedTypes)
+	}
+	for name := range ours {
+		if !theirs[name] {
+			return fmt.Errorf("allowed-type manifest mismatch: we allow %v, peer allows %v", wc.allowedTypeNames(), f.AllowedTypes)
+		}
+	}
+	return nil
+}
+
+func (wc *WebChan) allowedTypeNames() []string {
+	names := make([]string, 0, len(wc.allowedTypes))
+	for name := range wc.allowedTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (wc *WebChan) getAllowedTypeName(data interface{}) (string, bool) {
 	t := reflect.TypeOf(data)
 	for k, v := range wc.allowedTypes {
@@ -174,6 +453,7 @@ func (wc *WebChan) tryPushError(err error) {
 	select {
 	case wc.Error <- err:
 	default:
+		atomic.AddInt64(&wc.droppedErrors, 1)
 		fmt.Println("Error channel full, should probably check it more frequently")
 	}
 }
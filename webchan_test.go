@@ -1,8 +1,10 @@
 package webchan
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -47,3 +49,208 @@ func TestWebChan(t *testing.T) {
 		t.Errorf("Timeout waiting for message")
 	}
 }
+
+func TestWebChanNamedChans(t *testing.T) {
+	// Create a pair of connected sockets
+	a, b := net.Pipe()
+	wca, wcb := NewWebChan(a, 100, testType{}), NewWebChan(b, 100, testType{})
+	defer wca.Close()
+	defer wcb.Close()
+
+	// wca opens a named channel, wcb accepts it (the order these happen in doesn't matter,
+	// AcceptChan blocks until the peer's OpenChan has been seen).
+	aSend, _, err := wca.OpenChan("scores", testType{}, 10)
+	if err != nil {
+		t.Fatalf("OpenChan failed: %s", err)
+	}
+	_, bRecv, err := wcb.AcceptChan("scores")
+	if err != nil {
+		t.Fatalf("AcceptChan failed: %s", err)
+	}
+
+	aSend <- testType{A: 1, B: "one"}
+
+	select {
+	case msg := <-bRecv:
+		tt, ok := msg.(testType)
+		if !ok {
+			t.Errorf("Received unknown type (this should never happen in this program): %T", msg)
+		} else if tt.A != 1 || tt.B != "one" {
+			t.Errorf("Received unexpected data: %+v", tt)
+		}
+	case err := <-wcb.Error:
+		t.Errorf("Error with WebChan b: %s", err)
+	case err := <-wca.Error:
+		t.Errorf("Error with WebChan a: %s", err)
+	case <-time.After(time.Second * 2):
+		t.Errorf("Timeout waiting for message")
+	}
+
+	// Closing the sender's end of the named channel should close the peer's recv chan only.
+	close(aSend)
+	select {
+	case _, ok := <-bRecv:
+		if ok {
+			t.Errorf("Expected bRecv to be closed")
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("Timeout waiting for bRecv to close")
+	}
+}
+
+func TestWebChanCredit(t *testing.T) {
+	// Create a pair of connected sockets, each only willing to have 2 messages in flight at once.
+	a, b := net.Pipe()
+	wca := NewWebChanWithCredit(a, 10, 2, testType{})
+	wcb := NewWebChanWithCredit(b, 10, 2, testType{})
+	defer wca.Close()
+	defer wcb.Close()
+
+	// Use up all of wca's credit sending to wcb.
+	wca.Send <- testType{A: 1}
+	wca.Send <- testType{A: 2}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-wcb.Recv:
+			// Receiving each message acks it, returning wca's credit.
+		case err := <-wcb.Error:
+			t.Fatalf("Error with WebChan b: %s", err)
+		case err := <-wca.Error:
+			t.Fatalf("Error with WebChan a: %s", err)
+		case <-time.After(time.Second * 2):
+			t.Fatalf("Timeout waiting for message %d", i)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for wca.Stats().InFlightMessages != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for acks to return credit, stats: %+v", wca.Stats())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWebChanCall(t *testing.T) {
+	// Create a pair of connected sockets
+	a, b := net.Pipe()
+	wca, wcb := NewWebChan(a, 100, testType{}), NewWebChan(b, 100, testType{})
+	defer wca.Close()
+	defer wcb.Close()
+
+	// wcb handles requests: double A, echo B back unchanged.
+	err := wcb.Handle(testType{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		tt := req.(testType)
+		if tt.A < 0 {
+			return nil, fmt.Errorf("A must not be negative")
+		}
+		return testType{A: tt.A * 2, B: tt.B}, nil
+	})
+	if err != nil {
+		t.Fatalf("Handle failed: %s", err)
+	}
+
+	var resp testType
+	callErr := wca.Call(context.Background(), testType{A: 21, B: "hi"}, &resp)
+	if callErr != nil {
+		t.Fatalf("Call failed: %s", callErr)
+	}
+	if resp.A != 42 || resp.B != "hi" {
+		t.Errorf("Received unexpected response: %+v", resp)
+	}
+
+	// A handler error should come back as an error from Call, not a panic or a zero response.
+	if err := wca.Call(context.Background(), testType{A: -1}, &resp); err == nil {
+		t.Errorf("Expected an error from Call when the handler errors")
+	}
+}
+
+func TestWebChanCodec(t *testing.T) {
+	// Create a pair of connected sockets, both using GobCodec instead of the default JSONCodec.
+	a, b := net.Pipe()
+	wca := NewWebChanWithCodec(a, 100, &GobCodec{}, testType{})
+	wcb := NewWebChanWithCodec(b, 100, &GobCodec{}, testType{})
+	defer wca.Close()
+	defer wcb.Close()
+
+	wca.Send <- testType{A: 7, B: "gob"}
+
+	select {
+	case msg := <-wcb.Recv:
+		tt, ok := msg.(testType)
+		if !ok || tt.A != 7 || tt.B != "gob" {
+			t.Errorf("Received unexpected data: %+v (ok=%v)", msg, ok)
+		}
+	case err := <-wcb.Error:
+		t.Errorf("Error with WebChan b: %s", err)
+	case err := <-wca.Error:
+		t.Errorf("Error with WebChan a: %s", err)
+	case <-time.After(time.Second * 2):
+		t.Errorf("Timeout waiting for message")
+	}
+}
+
+// queueDialer is a test Dialer that hands out a fixed sequence of errors, then connections.
+type queueDialer struct {
+	mu    sync.Mutex
+	errs  []error
+	conns []net.Conn
+}
+
+func (d *queueDialer) Dial(ctx context.Context) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.errs) > 0 {
+		err := d.errs[0]
+		d.errs = d.errs[1:]
+		return nil, err
+	}
+	if len(d.conns) == 0 {
+		return nil, fmt.Errorf("queueDialer: no more connections queued")
+	}
+	c := d.conns[0]
+	d.conns = d.conns[1:]
+	return c, nil
+}
+
+func TestReconnectingWebChan(t *testing.T) {
+	a, b := net.Pipe()
+	// Seed one dial failure so the supervisor has to back off and retry before it succeeds.
+	dialer := &queueDialer{errs: []error{fmt.Errorf("boom")}, conns: []net.Conn{a}}
+	rwc := NewReconnectingWebChan(dialer, 10, ExponentialBackoff{Initial: time.Millisecond, Max: time.Millisecond * 5}, testType{})
+	defer rwc.Close()
+
+	// Use credit on the peer side too, so it doesn't treat rwc's credit handshake as a mismatch.
+	wcb := NewWebChanWithCredit(b, 10, 10, testType{})
+	defer wcb.Close()
+
+	connected := false
+	for !connected {
+		select {
+		case s := <-rwc.State:
+			if s == StateConnected {
+				connected = true
+			}
+		case <-rwc.Error:
+			// Expected: the seeded dial failure above surfaces here before the redial succeeds.
+		case <-time.After(time.Second * 2):
+			t.Fatalf("Timed out waiting to connect")
+		}
+	}
+
+	rwc.Send <- testType{A: 9, B: "ok"}
+	select {
+	case msg := <-wcb.Recv:
+		tt, ok := msg.(testType)
+		if !ok || tt.A != 9 || tt.B != "ok" {
+			t.Errorf("Received unexpected data: %+v (ok=%v)", msg, ok)
+		}
+	case err := <-wcb.Error:
+		t.Errorf("Error with wcb: %s", err)
+	case err := <-rwc.Error:
+		t.Errorf("Error with rwc: %s", err)
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Timeout waiting for message")
+	}
+}